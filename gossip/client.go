@@ -23,8 +23,8 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
-	circuit "github.com/rubyist/circuitbreaker"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/cockroachdb/cockroach/roachpb"
 	"github.com/cockroachdb/cockroach/rpc"
@@ -42,10 +42,14 @@ type client struct {
 	peerID                roachpb.NodeID           // Peer node ID; 0 until first gossip response
 	addr                  net.Addr                 // Peer node network address
 	forwardAddr           *util.UnresolvedAddr     // Set if disconnected with an alternate addr
+	forwardChain          []ForwardHop             // Hops the current forwardAddr traveled through
 	remoteHighWaterStamps map[roachpb.NodeID]int64 // Remote server's high water timestamps
 	closer                chan struct{}            // Client shutdown channel
 	clientMetrics         Metrics
 	nodeMetrics           Metrics
+	retryMetrics          clientRetryMetrics
+	trustedForwarders     *TrustedForwarderCIDRs // Addrs trusted to relay on others' behalf
+	maxForwardDepth       int                    // 0 uses defaultMaxForwardDepth
 }
 
 // extractKeys returns a string representation of a gossip delta's keys.
@@ -57,19 +61,40 @@ func extractKeys(delta map[string]*Info) string {
 	return fmt.Sprintf("%s", keys)
 }
 
-// newClient creates and returns a client struct.
-func newClient(ctx context.Context, addr net.Addr, nodeMetrics Metrics) *client {
+// newClient creates and returns a client struct. forwardChain seeds the
+// hops this dial already traveled through -- callers reconnecting a client
+// to the forwardAddr a previous client's handleResponse rejected-or-not
+// left behind should pass that client's ForwardChain() here, so that a
+// second forward observed on this connection is resolved against the full
+// chain rather than starting over at one hop.
+func newClient(
+	ctx context.Context,
+	addr net.Addr,
+	nodeMetrics Metrics,
+	trustedForwarders *TrustedForwarderCIDRs,
+	forwardChain []ForwardHop,
+) *client {
 	return &client{
-		ctx:       ctx,
-		createdAt: timeutil.Now(),
-		addr:      addr,
+		ctx:                   ctx,
+		createdAt:             timeutil.Now(),
+		addr:                  addr,
+		forwardChain:          forwardChain,
 		remoteHighWaterStamps: map[roachpb.NodeID]int64{},
 		closer:                make(chan struct{}),
 		clientMetrics:         makeMetrics(),
 		nodeMetrics:           nodeMetrics,
+		retryMetrics:          makeClientRetryMetrics(),
+		trustedForwarders:     trustedForwarders,
 	}
 }
 
+// ForwardChain returns the chain of forwarder hops, most recent last, that
+// led to the client's current forwardAddr. It's surfaced by the /debug/gossip
+// handler so operators can see why a connection was redirected.
+func (c *client) ForwardChain() []ForwardHop {
+	return c.forwardChain
+}
+
 // start dials the remote addr and commences gossip once connected. Upon exit,
 // the client is sent on the disconnected channel. This method starts client
 // processing in a goroutine and returns immediately.
@@ -79,7 +104,7 @@ func (c *client) start(
 	rpcCtx *rpc.Context,
 	stopper *stop.Stopper,
 	nodeID roachpb.NodeID,
-	breaker *circuit.Breaker,
+	policy RetryPolicy,
 ) {
 	stopper.RunWorker(func() {
 		ctx, cancel := context.WithCancel(c.ctx)
@@ -99,25 +124,8 @@ func (c *client) start(
 			disconnected <- c
 		}()
 
-		consecFailures := breaker.ConsecFailures()
-		var stream Gossip_GossipClient
-		if err := breaker.Call(func() error {
-			// Note: avoid using `grpc.WithBlock` here. This code is already
-			// asynchronous from the caller's perspective, so the only effect of
-			// `WithBlock` here is blocking shutdown - at the time of this writing,
-			// that ends ups up making `kv` tests take twice as long.
-			conn, err := rpcCtx.GRPCDial(c.addr.String())
-			if err != nil {
-				return err
-			}
-			if stream, err = NewGossipClient(conn).Gossip(ctx); err != nil {
-				return err
-			}
-			return c.requestGossip(g, stream)
-		}, 0); err != nil {
-			if consecFailures == 0 {
-				log.Warningf(ctx, "node %d: failed to start gossip client: %s", nodeID, err)
-			}
+		stream, ok := c.connectWithRetry(ctx, g, rpcCtx, stopper, nodeID, policy)
+		if !ok {
 			return
 		}
 
@@ -137,6 +145,83 @@ func (c *client) start(
 	})
 }
 
+// connectWithRetry dials the remote addr, opens a gossip stream, and sends
+// the initial gossip request, retrying between failures according to
+// policy until it succeeds or retrying is preempted by the client being
+// closed, the stopper quiescing, or the policy giving up (a permanent error
+// or MaxElapsedTime). It returns the established stream and true on
+// success, or false if the caller should give up.
+func (c *client) connectWithRetry(
+	ctx context.Context,
+	g *Gossip,
+	rpcCtx *rpc.Context,
+	stopper *stop.Stopper,
+	nodeID roachpb.NodeID,
+	policy RetryPolicy,
+) (Gossip_GossipClient, bool) {
+	backoff := newClientBackoff(policy, c.retryMetrics)
+	loggedFailure := false
+
+	for {
+		// Note: avoid using `grpc.WithBlock` here. This code is already
+		// asynchronous from the caller's perspective, so the only effect of
+		// `WithBlock` here is blocking shutdown - at the time of this writing,
+		// that ends ups up making `kv` tests take twice as long.
+		stream, err := c.dialAndRequestGossip(ctx, g, rpcCtx)
+		if err == nil {
+			if loggedFailure {
+				log.Infof(ctx, "node %d: gossip client to %s recovered", nodeID, c.addr)
+			}
+			backoff.reset()
+			return stream, true
+		}
+
+		if !loggedFailure {
+			log.Warningf(ctx, "node %d: failed to start gossip client: %s", nodeID, err)
+			loggedFailure = true
+		}
+		if policy.IsPermanentError != nil && policy.IsPermanentError(err) {
+			return nil, false
+		}
+
+		d, ok := backoff.nextBackoff()
+		if !ok {
+			return nil, false
+		}
+		select {
+		case <-time.After(d):
+		case <-c.closer:
+			return nil, false
+		case <-stopper.ShouldStop():
+			return nil, false
+		}
+	}
+}
+
+// dialAndRequestGossip dials the remote addr, opens a gossip stream, and
+// sends the initial gossip request, without any retry of its own. The
+// outgoing context carries a W3C tracecontext header (see
+// log.InjectTraceContext) so the receiving node's gossip handler can link
+// its processing of this stream into the dialing node's trace.
+func (c *client) dialAndRequestGossip(
+	ctx context.Context, g *Gossip, rpcCtx *rpc.Context,
+) (Gossip_GossipClient, error) {
+	conn, err := rpcCtx.GRPCDial(c.addr.String())
+	if err != nil {
+		return nil, err
+	}
+	md := metadata.MD{}
+	log.InjectTraceContext(ctx, md)
+	stream, err := NewGossipClient(conn).Gossip(metadata.NewOutgoingContext(ctx, md))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.requestGossip(g, stream); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
 // close stops the client gossip loop and returns immediately.
 func (c *client) close() {
 	select {
@@ -235,14 +320,51 @@ func (c *client) handleResponse(g *Gossip, reply *Response) error {
 			return errors.Errorf("received forward from node %d to %d (%s); already have active connection, skipping",
 				reply.NodeID, reply.AlternateNodeID, reply.AlternateAddr)
 		}
+
+		// A Response only ever carries the one hop the remote directly
+		// observed; the chain this client accumulates across successive
+		// forwards (seeded into this client by newClient's forwardChain
+		// argument, carried forward via ForwardChain() into the next
+		// newClient call) is what lets the trusted-CIDR walk below see past
+		// a single relay. ObservedAddr is c.addr -- the address this client
+		// itself dialed to get here -- never reply.AlternateAddr: the relay
+		// can claim anything about where to go next, but it can't spoof the
+		// address we're already, independently connected to it on.
+		stamp := timeutil.Now().UnixNano()
+		if n := len(c.forwardChain); n > 0 && stamp <= c.forwardChain[n-1].Timestamp {
+			stamp = c.forwardChain[n-1].Timestamp + 1
+		}
+		hops := append(append([]ForwardHop(nil), c.forwardChain...), ForwardHop{
+			NodeID:       reply.AlternateNodeID,
+			ObservedAddr: c.addr.String(),
+			Timestamp:    stamp,
+		})
+		resolvedAddr, err := resolveForwardChain(
+			hops, c.trustedForwarders, g.mu.is.NodeID, c.maxForwardDepth, reply.AlternateAddr.String())
+		if err != nil {
+			return errors.Wrapf(err, "rejecting forward from node %d to %d (%s)",
+				reply.NodeID, reply.AlternateNodeID, reply.AlternateAddr)
+		}
+
 		// We try to resolve the address, but don't actually use the result.
 		// The certificates (if any) may only be valid for the unresolved
 		// address.
 		if _, err := reply.AlternateAddr.Resolve(); err != nil {
 			return errors.Errorf("unable to resolve alternate address %s for node %d: %s", reply.AlternateAddr, reply.AlternateNodeID, err)
 		}
-		c.forwardAddr = reply.AlternateAddr
-		return errors.Errorf("received forward from node %d to %d (%s)", reply.NodeID, reply.AlternateNodeID, reply.AlternateAddr)
+		// resolvedAddr is reply.AlternateAddr itself once resolveForwardChain
+		// has confirmed every relay between here and the origin is a
+		// recognized proxy; had any of them not been, the error return above
+		// would already have rejected this forward.
+		//
+		// NewUnresolvedAddr returns UnresolvedAddr by value (see
+		// util/unresolved_addr.go), so forwardAddr -- a *util.UnresolvedAddr
+		// field -- takes the address of the local copy.
+		resolved := util.NewUnresolvedAddr(reply.AlternateAddr.Network(), resolvedAddr)
+		c.forwardAddr = &resolved
+		c.forwardChain = hops
+		return errors.Errorf("received forward from node %d to %d (%s), resolved peer address %s",
+			reply.NodeID, reply.AlternateNodeID, reply.AlternateAddr, resolvedAddr)
 	}
 
 	// Check whether we're connected at this point.
@@ -0,0 +1,134 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+)
+
+// defaultMaxForwardDepth bounds how many hops a forward chain may contain
+// before handleResponse rejects it outright, absent an explicit override.
+const defaultMaxForwardDepth = 8
+
+// ForwardHop records one hop a gossip Response's AlternateAddr traveled
+// through before reaching this node. A single Response only ever carries
+// one hop (AlternateNodeID/AlternateAddr); handleResponse builds a
+// multi-hop chain by appending that hop to the client's existing
+// forwardChain (itself seeded from the previous client's ForwardChain() by
+// whichever forward hop dials the next client), so a connection relayed
+// through several nodes in turn resolves against the whole chain instead
+// of just the last link.
+type ForwardHop struct {
+	// NodeID is the node the relay at ObservedAddr forwarded us to.
+	NodeID roachpb.NodeID
+	// ObservedAddr is the address of the relay that issued this forward --
+	// the address this node itself dialed (client.addr) or accepted the
+	// connection from, never the AlternateAddr the relay merely claims the
+	// next hop lives at. A relay can say anything about where to go next;
+	// it can't spoof the address we're independently, already connected to
+	// it on, which is what resolveForwardChain actually trusts.
+	ObservedAddr string
+	// Timestamp is this node's clock reading (UnixNano) when it recorded the
+	// hop, bumped where needed so it strictly increases along a chain. It is
+	// used only to order hops for display; it is not trusted for correctness.
+	Timestamp int64
+}
+
+// TrustedForwarderCIDRs is a set of CIDR blocks whose members are trusted
+// to relay gossip connections on behalf of other nodes -- for example, L4
+// proxies fronting gossip traffic in deployments where nodes don't dial
+// each other directly. Only a relay whose own (independently observed)
+// address falls within this set may redirect a client elsewhere.
+type TrustedForwarderCIDRs struct {
+	nets []*net.IPNet
+}
+
+// NewTrustedForwarderCIDRs parses cidrs into a TrustedForwarderCIDRs set.
+func NewTrustedForwarderCIDRs(cidrs ...string) (*TrustedForwarderCIDRs, error) {
+	t := &TrustedForwarderCIDRs{}
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing trusted forwarder CIDR %q", cidr)
+		}
+		t.nets = append(t.nets, n)
+	}
+	return t, nil
+}
+
+// contains reports whether addr (a "host:port" or bare host) falls within
+// t. A nil *TrustedForwarderCIDRs trusts nothing.
+func (t *TrustedForwarderCIDRs) contains(addr string) bool {
+	if t == nil {
+		return false
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveForwardChain validates every relay in hops by its own
+// independently-observed address (ForwardHop.ObservedAddr, never a relay's
+// mere claim about where to go next) against trusted. If every relay in
+// the chain is a recognized proxy, the forward is believed and
+// fallbackAddr -- the address most recently advertised as the next hop --
+// is returned for the caller to dial. If any relay's own address falls
+// outside trusted, resolveForwardChain rejects the forward outright: an
+// unrecognized node has no standing to redirect a client anywhere,
+// regardless of how innocuous the address it names looks.
+//
+// It is also an error for the chain to loop back through selfNodeID (which
+// would indicate a forwarding cycle through this node) or to exceed
+// maxDepth hops (a non-positive maxDepth uses defaultMaxForwardDepth). Both
+// are treated as evidence of a spoofed or malformed forward rather than a
+// legitimate proxy topology.
+func resolveForwardChain(
+	hops []ForwardHop, trusted *TrustedForwarderCIDRs, selfNodeID roachpb.NodeID, maxDepth int, fallbackAddr string,
+) (string, error) {
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxForwardDepth
+	}
+	if len(hops) > maxDepth {
+		return "", errors.Errorf("forward chain exceeds max depth %d (have %d hops)", maxDepth, len(hops))
+	}
+	for _, hop := range hops {
+		if hop.NodeID == selfNodeID {
+			return "", errors.Errorf("forward chain loops back through this node (%d)", selfNodeID)
+		}
+		if !trusted.contains(hop.ObservedAddr) {
+			return "", errors.Errorf(
+				"forward relayed through untrusted address %s (node %d); refusing to follow",
+				hop.ObservedAddr, hop.NodeID)
+		}
+	}
+	return fallbackAddr, nil
+}
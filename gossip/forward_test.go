@@ -0,0 +1,109 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+)
+
+func TestResolveForwardChainRejectsUntrustedRelay(t *testing.T) {
+	trusted, err := NewTrustedForwarderCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The relay itself -- the address this node dialed -- is outside the
+	// trusted set, so its claim about the next hop can't be believed no
+	// matter how plausible that claim looks.
+	hops := []ForwardHop{{NodeID: 2, ObservedAddr: "192.168.1.5:26257"}}
+	if _, err := resolveForwardChain(hops, trusted, 1, 0, "attacker-picked:0"); err == nil {
+		t.Error("expected an error when the relay's own address is untrusted")
+	}
+}
+
+func TestResolveForwardChainTrustedRelayReturnsFallback(t *testing.T) {
+	trusted, err := NewTrustedForwarderCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops := []ForwardHop{{NodeID: 2, ObservedAddr: "10.1.2.3:26257"}}
+	addr, err := resolveForwardChain(hops, trusted, 1, 0, "fallback:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "fallback:0" {
+		t.Errorf("expected the advertised next hop once the relay is trusted, got %s", addr)
+	}
+}
+
+func TestResolveForwardChainMultiHopAllTrusted(t *testing.T) {
+	trusted, err := NewTrustedForwarderCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops := []ForwardHop{
+		{NodeID: 2, ObservedAddr: "10.1.2.3:26257"},
+		{NodeID: 3, ObservedAddr: "10.1.2.4:26257"},
+	}
+	addr, err := resolveForwardChain(hops, trusted, 1, 0, "fallback:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "fallback:0" {
+		t.Errorf("expected the advertised next hop once every relay is trusted, got %s", addr)
+	}
+}
+
+func TestResolveForwardChainMultiHopOneUntrusted(t *testing.T) {
+	trusted, err := NewTrustedForwarderCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops := []ForwardHop{
+		{NodeID: 2, ObservedAddr: "10.1.2.3:26257"},
+		{NodeID: 3, ObservedAddr: "192.168.1.5:26257"}, // not a recognized relay
+	}
+	if _, err := resolveForwardChain(hops, trusted, 1, 0, "fallback:0"); err == nil {
+		t.Error("expected an error when any relay in the chain is untrusted")
+	}
+}
+
+func TestResolveForwardChainRejectsLoop(t *testing.T) {
+	trusted, err := NewTrustedForwarderCIDRs("192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops := []ForwardHop{{NodeID: 5, ObservedAddr: "192.168.1.5:26257"}}
+	if _, err := resolveForwardChain(hops, trusted, 5, 0, "fallback:0"); err == nil {
+		t.Error("expected an error when the forward chain loops back through this node")
+	}
+}
+
+func TestResolveForwardChainRejectsExcessiveDepth(t *testing.T) {
+	trusted, err := NewTrustedForwarderCIDRs("192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops := make([]ForwardHop, defaultMaxForwardDepth+1)
+	for i := range hops {
+		hops[i] = ForwardHop{NodeID: roachpb.NodeID(i + 10), ObservedAddr: "192.168.1.5:26257"}
+	}
+	if _, err := resolveForwardChain(hops, trusted, 1, 0, "fallback:0"); err == nil {
+		t.Error("expected an error when the forward chain exceeds the max depth")
+	}
+}
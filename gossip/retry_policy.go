@@ -0,0 +1,158 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/metric"
+	"github.com/cockroachdb/cockroach/util/timeutil"
+)
+
+var (
+	metaClientRetries = metric.Metadata{
+		Name: "gossip.client.retries",
+		Help: "Number of gossip client connection attempts that failed and were retried",
+	}
+	metaClientBackoffMillis = metric.Metadata{
+		Name: "gossip.client.backoff_ms",
+		Help: "Most recently applied gossip client reconnection backoff, in milliseconds",
+	}
+)
+
+// clientRetryMetrics holds the metrics emitted by a client's RetryPolicy
+// loop. It's separate from the per-client/per-node Metrics struct because
+// it tracks the connection-retry process itself, rather than bytes or
+// infos flowing over an established connection.
+type clientRetryMetrics struct {
+	Retries       *metric.Counter
+	BackoffMillis *metric.Gauge
+}
+
+func makeClientRetryMetrics() clientRetryMetrics {
+	return clientRetryMetrics{
+		Retries:       metric.NewCounter(metaClientRetries),
+		BackoffMillis: metric.NewGauge(metaClientBackoffMillis),
+	}
+}
+
+// RetryPolicy configures the exponential backoff with full jitter used by a
+// gossip client between failed attempts to dial a peer, open a gossip
+// stream, and perform the initial gossip request. It replaces the fixed
+// rubyist/circuitbreaker.Breaker previously wired into client.start, which
+// gave up after a single failure and relied entirely on the outer gossip
+// loop to retry with no backoff of its own.
+type RetryPolicy struct {
+	// InitialInterval is the backoff before the first retry.
+	InitialInterval time.Duration
+	// MaxInterval caps the backoff between retries.
+	MaxInterval time.Duration
+	// Multiplier grows the backoff interval after each retry.
+	Multiplier float64
+	// RandomizationFactor scales the "full jitter" applied to each
+	// interval: the actual sleep is chosen uniformly from
+	// [0, interval*(1+RandomizationFactor)).
+	RandomizationFactor float64
+	// MaxElapsedTime bounds the total time spent retrying since the policy
+	// was reset. Zero means retry forever; DefaultRetryPolicy does not use
+	// zero, since a client that never gives up on a dead address never sends
+	// on disconnected either, leaving the gossip manager with no signal to
+	// fall back to another resolver.
+	MaxElapsedTime time.Duration
+	// IsPermanentError, if set, is consulted after each failure; if it
+	// returns true, the backoff loop stops retrying and the client gives up
+	// at once instead of scheduling another attempt; the error itself is not
+	// returned to the caller.
+	IsPermanentError func(error) bool
+
+	// randFloat64 is a test hook: it defaults to rand.Float64 and can be
+	// overridden within the package to make jitter deterministic in unit
+	// tests.
+	randFloat64 func() float64
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used by gossip clients unless
+// overridden.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval:     100 * time.Millisecond,
+		MaxInterval:         10 * time.Second,
+		Multiplier:          2,
+		RandomizationFactor: 0.5,
+		MaxElapsedTime:      2 * time.Minute,
+	}
+}
+
+// clientBackoff tracks the mutable state of a RetryPolicy as it's applied
+// across repeated connection attempts by a single client.
+type clientBackoff struct {
+	policy    RetryPolicy
+	attempt   int
+	startedAt time.Time
+	metrics   clientRetryMetrics
+}
+
+func newClientBackoff(policy RetryPolicy, metrics clientRetryMetrics) *clientBackoff {
+	return &clientBackoff{policy: policy, metrics: metrics}
+}
+
+// reset clears accumulated retry state, as though no attempts had yet been
+// made. Called whenever a gossip stream is successfully established.
+func (b *clientBackoff) reset() {
+	b.attempt = 0
+	b.startedAt = time.Time{}
+}
+
+// nextBackoff returns the interval to sleep before the next retry and
+// whether retrying is still permitted under MaxElapsedTime. It also records
+// the gossip.client.retries and gossip.client.backoff_ms metrics for the
+// attempt just recorded.
+func (b *clientBackoff) nextBackoff() (time.Duration, bool) {
+	if b.attempt == 0 {
+		b.startedAt = timeutil.Now()
+	}
+	b.attempt++
+
+	if b.policy.MaxElapsedTime > 0 && time.Since(b.startedAt) > b.policy.MaxElapsedTime {
+		return 0, false
+	}
+	b.metrics.Retries.Inc(1)
+
+	interval := float64(b.policy.InitialInterval)
+	mult := b.policy.Multiplier
+	if mult <= 1 {
+		mult = 1
+	}
+	for i := 1; i < b.attempt; i++ {
+		interval *= mult
+	}
+	if max := float64(b.policy.MaxInterval); b.policy.MaxInterval > 0 && interval > max {
+		interval = max
+	}
+
+	randFn := b.policy.randFloat64
+	if randFn == nil {
+		randFn = rand.Float64
+	}
+	// Full jitter: sleep is uniformly distributed across
+	// [0, interval*(1+RandomizationFactor)).
+	jittered := time.Duration(interval * (1 + b.policy.RandomizationFactor) * randFn())
+	b.metrics.BackoffMillis.Update(jittered.Nanoseconds() / int64(time.Millisecond))
+
+	return jittered, true
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"testing"
+	"time"
+)
+
+// deterministicPolicy returns a RetryPolicy whose jitter always lands at
+// the top of the interval, making backoff growth assertable exactly.
+func deterministicPolicy() RetryPolicy {
+	p := DefaultRetryPolicy()
+	p.InitialInterval = 10 * time.Millisecond
+	p.MaxInterval = 100 * time.Millisecond
+	p.Multiplier = 2
+	p.RandomizationFactor = 0
+	p.randFloat64 = func() float64 { return 1 }
+	return p
+}
+
+func TestClientBackoffGrowsAndCaps(t *testing.T) {
+	b := newClientBackoff(deterministicPolicy(), makeClientRetryMetrics())
+
+	expected := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		80 * time.Millisecond,
+		100 * time.Millisecond, // capped by MaxInterval
+		100 * time.Millisecond,
+	}
+	for i, want := range expected {
+		got, ok := b.nextBackoff()
+		if !ok {
+			t.Fatalf("attempt %d: expected retrying to still be permitted", i)
+		}
+		if got != want {
+			t.Errorf("attempt %d: expected backoff %s, got %s", i, want, got)
+		}
+	}
+}
+
+func TestClientBackoffReset(t *testing.T) {
+	b := newClientBackoff(deterministicPolicy(), makeClientRetryMetrics())
+
+	if _, ok := b.nextBackoff(); !ok {
+		t.Fatal("expected first backoff to be permitted")
+	}
+	if _, ok := b.nextBackoff(); !ok {
+		t.Fatal("expected second backoff to be permitted")
+	}
+	b.reset()
+
+	got, ok := b.nextBackoff()
+	if !ok {
+		t.Fatal("expected backoff after reset to be permitted")
+	}
+	if want := 10 * time.Millisecond; got != want {
+		t.Errorf("expected backoff after reset to restart at %s, got %s", want, got)
+	}
+}
+
+func TestClientBackoffMaxElapsedTime(t *testing.T) {
+	p := deterministicPolicy()
+	p.MaxElapsedTime = 10 * time.Millisecond
+	b := newClientBackoff(p, makeClientRetryMetrics())
+
+	if _, ok := b.nextBackoff(); !ok {
+		t.Fatal("expected the first attempt to be permitted")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := b.nextBackoff(); ok {
+		t.Error("expected retrying to be disallowed once MaxElapsedTime has passed")
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/cockroachdb/cockroach/util/timeutil"
+)
+
+// defaultSubscriptionBufferSize is used when SubscribeOptions.BufferSize is
+// left at its zero value.
+const defaultSubscriptionBufferSize = 256
+
+// OverflowPolicy determines what a Subscription does when its consumer
+// falls behind and the buffered Events channel is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks delivery until the consumer drains the channel
+	// or the subscription is unsubscribed.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest buffered event to make room
+	// for the new one.
+	OverflowDropOldest
+	// OverflowError drops the new event and records it via Dropped().
+	OverflowError
+)
+
+// Event describes a single gossip update delivered to a Subscription.
+type Event struct {
+	// Key is the gossip info key that changed.
+	Key string
+	// Value is the decoded value now associated with Key.
+	Value roachpb.Value
+	// PriorValue is the value this subscription last observed for Key, if
+	// the subscription was created with Coalesce and one was observed. That
+	// earlier event may itself have been dropped on overflow.
+	PriorValue *roachpb.Value
+	// NodeID is the node which originated Value, if known.
+	NodeID roachpb.NodeID
+	// OrigStamp is NodeID's own clock reading when it produced Value, if
+	// known. It's informational only -- comparing it against another node's
+	// clock (including this node's) is meaningless across a cluster with
+	// skewed clocks -- and is not used to order or classify events.
+	OrigStamp int64
+	// ReceivedAt is the time this node locally received Value, regardless of
+	// when NodeID produced it.
+	ReceivedAt time.Time
+}
+
+// SubscribeOptions configures a call to Gossip.Subscribe.
+type SubscribeOptions struct {
+	// Coalesce causes each delivered Event to carry the value last observed
+	// for the same key, if any, in PriorValue.
+	Coalesce bool
+	// SendSnapshot causes Subscribe to additionally deliver an Event for
+	// every currently-known key matching pattern, alongside future updates.
+	// Snapshot events are told apart from live ones by comparing each
+	// value's OrigStamp against the per-node high-water mark this node had
+	// already recorded for that same origin as of the subscribe call --
+	// never against this node's own clock, which a differently-skewed
+	// origin clock could fool -- so they may arrive interleaved with early
+	// live updates rather than strictly before them.
+	SendSnapshot bool
+	// BufferSize bounds the number of undelivered events buffered for the
+	// subscriber. Defaults to defaultSubscriptionBufferSize.
+	BufferSize int
+	// Overflow selects the behavior when the buffer is full.
+	Overflow OverflowPolicy
+}
+
+// Subscription is a consumer-facing handle on a gossip Subscribe call. Its
+// Events channel delivers updates to keys matching the subscription's
+// pattern until Unsubscribe is called.
+type Subscription struct {
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+	// mu guards closed and is held by deliver for the duration of every
+	// send attempt on events. unregister does not guarantee an
+	// already-dispatched callback can't still run after it returns, so
+	// Unsubscribe can't rely on call order to know events is safe to close;
+	// instead every deliver takes mu.RLock and checks closed before
+	// touching events at all, and Unsubscribe takes mu.Lock to flip closed
+	// and close events. Since a pending Lock call blocks new RLock callers
+	// (sync.RWMutex's documented fairness), no deliver that acquires the
+	// lock after Unsubscribe starts can observe events as still open.
+	mu     sync.RWMutex
+	closed bool
+
+	unregister func()
+	overflow   OverflowPolicy
+	dropped    int64 // atomic
+
+	priorMu struct {
+		sync.Mutex
+		values map[string]roachpb.Value
+	}
+}
+
+// Events returns the channel on which matching gossip updates are
+// delivered. The channel is closed when Unsubscribe is called.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events dropped so far because the buffer
+// was full and the subscription uses OverflowError.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Unsubscribe stops delivery of further events and releases the
+// subscription's callback registration. It is idempotent and safe to call
+// more than once or concurrently with event delivery.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		// unregister may let an already-dispatched callback run after it
+		// returns, so close(done) first to wake any deliver parked in a
+		// blocking select; mu.Lock then waits out any deliver already past
+		// that point (bounded now that done is closed) before it's safe to
+		// flip closed and close events -- see the Subscription.mu doc
+		// comment for why no later deliver can race past this point.
+		s.unregister()
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		close(s.events)
+		s.mu.Unlock()
+	})
+}
+
+func (s *Subscription) deliver(ev Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	switch s.overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.events <- ev:
+				return
+			case <-s.done:
+				return
+			default:
+			}
+			select {
+			case <-s.events:
+			default:
+			}
+		}
+	case OverflowError:
+		select {
+		case s.events <- ev:
+		case <-s.done:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	default: // OverflowBlock
+		select {
+		case s.events <- ev:
+		case <-s.done:
+		}
+	}
+}
+
+// Subscribe registers a subscription for gossip updates to keys matching
+// pattern (a regular expression, as accepted by RegisterCallback) and
+// returns a Subscription whose Events channel receives a gossip.Event per
+// matching update. Unlike RegisterCallback, which invokes its callback
+// under tight coupling to the gossip update path, Subscribe multiplexes
+// callback delivery onto a buffered channel, so a slow consumer holds up the
+// callback only once that buffer is full and only under OverflowBlock (the
+// default), which waits for the consumer to drain; OverflowDropOldest and
+// OverflowError never wait. It is safe to create many concurrent
+// Subscriptions to the same or overlapping patterns.
+//
+// Consumers that previously wired up ad-hoc RegisterCallback-plus-mutex
+// patterns (store pool, node liveness, the SQL lease manager) can use this
+// instead to get per-key ordering without hand-rolled bookkeeping: updates
+// to a given key are always delivered to a given Subscription in the order
+// gossip applied them.
+func (g *Gossip) Subscribe(pattern string, opts SubscribeOptions) (*Subscription, error) {
+	return subscribe(g, g.lookupInfoLocked, g.highWaterStampsLocked, pattern, opts)
+}
+
+// lookupInfoLocked returns the NodeID and OrigStamp most recently recorded
+// for key, acquiring g.mu for the duration of the lookup.
+func (g *Gossip) lookupInfoLocked(key string) (nodeID roachpb.NodeID, origStamp int64, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if info := g.mu.is.getInfo(key); info != nil {
+		return info.NodeID, info.OrigStamp, true
+	}
+	return 0, 0, false
+}
+
+// highWaterStampsLocked returns a copy of the highest OrigStamp this node
+// has recorded so far for each originating node, acquiring g.mu for the
+// duration of the call. subscribe uses a snapshot of this map, taken once
+// at subscribe time, to tell a key's preexisting value apart from one
+// updated afterward -- by comparing a later OrigStamp against the mark this
+// same origin node had already reached, never against this node's own
+// clock.
+func (g *Gossip) highWaterStampsLocked() map[roachpb.NodeID]int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.mu.is.getHighWaterStamps()
+}
+
+// callbackRegistrar is the subset of Gossip's API that subscribe depends on.
+// It exists so subscribe's wiring -- in particular the interaction between
+// RegisterCallback's unregister func and a Subscription's safe shutdown --
+// can be exercised by a test without constructing a real Gossip.
+type callbackRegistrar interface {
+	RegisterCallback(pattern string, method func(string, roachpb.Value)) func()
+}
+
+// subscribe implements Gossip.Subscribe against reg and lookup rather than
+// a concrete *Gossip, so it can be driven directly in tests.
+func subscribe(
+	reg callbackRegistrar,
+	lookup func(key string) (nodeID roachpb.NodeID, origStamp int64, ok bool),
+	highWaterStamps func() map[roachpb.NodeID]int64,
+	pattern string,
+	opts SubscribeOptions,
+) (*Subscription, error) {
+	bufSize := opts.BufferSize
+	if bufSize <= 0 {
+		bufSize = defaultSubscriptionBufferSize
+	}
+
+	sub := &Subscription{
+		events:   make(chan Event, bufSize),
+		done:     make(chan struct{}),
+		overflow: opts.Overflow,
+	}
+	sub.priorMu.values = map[string]roachpb.Value{}
+
+	// baseline marks, per originating node, how far that node's own clock
+	// had already been observed to reach when Subscribe was called.
+	// RegisterCallback's initial replay of currently-matching keys isn't
+	// ordered against RegisterCallback returning -- it can run on a
+	// goroutine that hasn't even started by the time this function resumes
+	// -- so there's no call-order signal to gate SendSnapshot on. Comparing
+	// each delivered value's own OrigStamp against baseline[nodeID] (rather
+	// than against this node's clock) classifies snapshot vs. live
+	// correctly regardless of when the registry gets around to the replay,
+	// and regardless of clock skew between origin nodes.
+	baseline := highWaterStamps()
+	callback := func(key string, value roachpb.Value) {
+		var nodeID roachpb.NodeID
+		var origStamp int64
+		if id, stamp, ok := lookup(key); ok {
+			if !opts.SendSnapshot {
+				if base, known := baseline[id]; known && stamp <= base {
+					return
+				}
+			}
+			nodeID = id
+			origStamp = stamp
+		}
+
+		ev := Event{
+			Key:        key,
+			Value:      value,
+			NodeID:     nodeID,
+			OrigStamp:  origStamp,
+			ReceivedAt: timeutil.Now(),
+		}
+
+		if opts.Coalesce {
+			sub.priorMu.Lock()
+			if prior, ok := sub.priorMu.values[key]; ok {
+				priorCopy := prior
+				ev.PriorValue = &priorCopy
+			}
+			sub.priorMu.values[key] = value
+			sub.priorMu.Unlock()
+		}
+
+		sub.deliver(ev)
+	}
+
+	sub.unregister = reg.RegisterCallback(pattern, callback)
+
+	if sub.unregister == nil {
+		return nil, errors.Errorf("gossip: failed to register subscription for pattern %q", pattern)
+	}
+	return sub, nil
+}
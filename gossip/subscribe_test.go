@@ -0,0 +1,226 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package gossip
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+)
+
+// noHighWaterStamps stands in for a node that has recorded nothing locally
+// yet, so every lookup result is treated as live regardless of SendSnapshot.
+func noHighWaterStamps() map[roachpb.NodeID]int64 { return nil }
+
+// fakeRegistrar is a minimal callbackRegistrar that invokes every
+// registered callback synchronously from publish, letting tests drive the
+// actual subscribe() wiring (as opposed to constructing a bare
+// *Subscription) with concurrent publishers of their own choosing.
+type fakeRegistrar struct {
+	mu        sync.Mutex
+	callbacks map[int]func(string, roachpb.Value)
+	nextID    int
+}
+
+func (r *fakeRegistrar) RegisterCallback(
+	pattern string, method func(string, roachpb.Value),
+) func() {
+	r.mu.Lock()
+	if r.callbacks == nil {
+		r.callbacks = map[int]func(string, roachpb.Value){}
+	}
+	id := r.nextID
+	r.nextID++
+	r.callbacks[id] = method
+	r.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.callbacks, id)
+			r.mu.Unlock()
+		})
+	}
+}
+
+func (r *fakeRegistrar) publish(key string, value roachpb.Value) {
+	r.mu.Lock()
+	callbacks := make([]func(string, roachpb.Value), 0, len(r.callbacks))
+	for _, cb := range r.callbacks {
+		callbacks = append(callbacks, cb)
+	}
+	r.mu.Unlock()
+	for _, cb := range callbacks {
+		cb(key, value)
+	}
+}
+
+// TestSubscriptionOverflowDropOldest exercises the drop-oldest overflow
+// policy against a Subscription directly, independent of an actual Gossip
+// instance, since delivery bookkeeping lives entirely on *Subscription.
+func TestSubscriptionOverflowDropOldest(t *testing.T) {
+	sub := &Subscription{
+		events:     make(chan Event, 2),
+		done:       make(chan struct{}),
+		overflow:   OverflowDropOldest,
+		unregister: func() {},
+	}
+
+	sub.deliver(Event{Key: "a"})
+	sub.deliver(Event{Key: "b"})
+	sub.deliver(Event{Key: "c"})
+
+	var keys []string
+	for i := 0; i < 2; i++ {
+		keys = append(keys, (<-sub.Events()).Key)
+	}
+	if len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+		t.Errorf("expected oldest event to be dropped, got %v", keys)
+	}
+}
+
+// TestSubscriptionOverflowError exercises the error overflow policy, which
+// drops new events (instead of the oldest) once the buffer is full and
+// records the count via Dropped().
+func TestSubscriptionOverflowError(t *testing.T) {
+	sub := &Subscription{
+		events:     make(chan Event, 1),
+		done:       make(chan struct{}),
+		overflow:   OverflowError,
+		unregister: func() {},
+	}
+
+	sub.deliver(Event{Key: "a"})
+	sub.deliver(Event{Key: "b"})
+
+	if dropped := sub.Dropped(); dropped != 1 {
+		t.Errorf("expected 1 dropped event, got %d", dropped)
+	}
+	if ev := <-sub.Events(); ev.Key != "a" {
+		t.Errorf("expected buffered event %q to survive, got %q", "a", ev.Key)
+	}
+}
+
+func TestSubscriptionUnsubscribeIdempotent(t *testing.T) {
+	var unregistered int
+	sub := &Subscription{
+		events:     make(chan Event, 1),
+		done:       make(chan struct{}),
+		unregister: func() { unregistered++ },
+	}
+
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+
+	if unregistered != 1 {
+		t.Errorf("expected unregister to be called once, got %d", unregistered)
+	}
+	if _, ok := <-sub.Events(); ok {
+		t.Errorf("expected Events channel to be closed after Unsubscribe")
+	}
+}
+
+// TestSubscribeConcurrentPublishAndUnsubscribe drives subscribe() (the
+// function backing Gossip.Subscribe) against a fakeRegistrar with several
+// goroutines concurrently publishing updates while Unsubscribe is called
+// mid-stream. It exists to catch the send-on-closed-channel race between
+// deliver and Unsubscribe; run with -race.
+func TestSubscribeConcurrentPublishAndUnsubscribe(t *testing.T) {
+	reg := &fakeRegistrar{}
+	lookup := func(key string) (roachpb.NodeID, int64, bool) { return 0, 0, false }
+
+	sub, err := subscribe(reg, lookup, noHighWaterStamps, ".*", SubscribeOptions{
+		SendSnapshot: true,
+		BufferSize:   4,
+		Overflow:     OverflowDropOldest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var drainWG sync.WaitGroup
+	drainWG.Add(1)
+	go func() {
+		defer drainWG.Done()
+		for range sub.Events() {
+		}
+	}()
+
+	var pubWG sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		pubWG.Add(1)
+		go func(i int) {
+			defer pubWG.Done()
+			for j := 0; j < 200; j++ {
+				reg.publish("key", roachpb.Value{})
+			}
+		}(i)
+	}
+
+	// Unsubscribe mid-stream, racing against the publishers above.
+	sub.Unsubscribe()
+
+	pubWG.Wait()
+	drainWG.Wait()
+}
+
+// TestSubscribeSendSnapshotFalseSuppressesPreexisting exercises the
+// baseline/OrigStamp comparison that stands in for a replay-vs-live signal
+// RegisterCallback doesn't provide: a key whose recorded OrigStamp is at or
+// below the high-water mark already reached for its origin node as of the
+// subscribe call should be suppressed when SendSnapshot is false, while one
+// past that mark should still be delivered. Both keys originate from the
+// same node (1) and are compared only against that node's own prior mark --
+// never against this node's clock -- so the classification holds regardless
+// of clock skew between nodes.
+func TestSubscribeSendSnapshotFalseSuppressesPreexisting(t *testing.T) {
+	reg := &fakeRegistrar{}
+	lookup := func(key string) (roachpb.NodeID, int64, bool) {
+		switch key {
+		case "preexisting":
+			return 1, 100, true
+		case "fresh":
+			return 1, 200, true
+		default:
+			return 0, 0, false
+		}
+	}
+	highWaterStamps := func() map[roachpb.NodeID]int64 {
+		return map[roachpb.NodeID]int64{1: 100}
+	}
+
+	sub, err := subscribe(reg, lookup, highWaterStamps, ".*", SubscribeOptions{BufferSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	reg.publish("preexisting", roachpb.Value{})
+	reg.publish("fresh", roachpb.Value{})
+
+	ev, ok := <-sub.Events()
+	if !ok || ev.Key != "fresh" {
+		t.Fatalf("expected only the post-subscribe update to be delivered, got %+v (ok=%v)", ev, ok)
+	}
+	select {
+	case extra, ok := <-sub.Events():
+		t.Fatalf("expected preexisting key to be suppressed, got extra event %+v (ok=%v)", extra, ok)
+	default:
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+//
+// Author: Tobias Schottdorf (tobias.schottdorf@gmail.com)
+
+package log
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestInitOTLPExporterNoop(t *testing.T) {
+	ctx := context.Background()
+
+	shutdown, err := InitOTLPExporter(ctx, OTLPConfig{})
+	if err != nil {
+		t.Fatalf("expected no error configuring a no-op exporter, got %s", err)
+	}
+	if err := shutdown(ctx); err != nil {
+		t.Errorf("expected shutdown of a no-op exporter to succeed, got %s", err)
+	}
+}
+
+func TestDefaultOTLPConfig(t *testing.T) {
+	cfg := DefaultOTLPConfig()
+	if cfg.SamplingRatio != 1.0 {
+		t.Errorf("expected default sampling ratio of 1.0, got %f", cfg.SamplingRatio)
+	}
+	if cfg.BatchTimeout <= 0 {
+		t.Errorf("expected a positive default batch timeout, got %s", cfg.BatchTimeout)
+	}
+}
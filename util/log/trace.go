@@ -0,0 +1,346 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+//
+// Author: Tobias Schottdorf (tobias.schottdorf@gmail.com)
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+
+	opentracing "github.com/opentracing/opentracing-go"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// Tracer creates OpenTelemetry spans for this binary. It is the successor
+// to the basictracer.Tracer previously constructed ad hoc wherever tracing
+// was wired in; all production tracing now flows through a *Tracer backed
+// by the global TracerProvider installed by InitOTLPExporter.
+type Tracer struct {
+	ot oteltrace.Tracer
+}
+
+// NewTracer returns a Tracer that creates spans using the currently
+// installed global OpenTelemetry TracerProvider.
+func NewTracer() *Tracer {
+	return &Tracer{ot: otel.Tracer("github.com/cockroachdb/cockroach/util/log")}
+}
+
+// StartSpan starts a new OpenTelemetry span named operationName and returns
+// a context carrying it alongside the span itself.
+func (t *Tracer) StartSpan(
+	ctx context.Context, operationName string,
+) (context.Context, oteltrace.Span) {
+	return t.ot.Start(ctx, operationName)
+}
+
+// OTLPConfig configures the OTLP exporter used to ship spans to a
+// collector. Fields are typically populated from flags or from the
+// environment variables conventionally recognized by OTel SDKs (e.g.
+// OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_HEADERS).
+type OTLPConfig struct {
+	// Endpoint is the collector address. A "http://" or "https://" prefix
+	// selects the HTTP exporter; anything else (e.g. "collector:4317") is
+	// dialed with the gRPC exporter.
+	Endpoint string
+	// Insecure disables TLS when dialing Endpoint with the gRPC exporter.
+	Insecure bool
+	// Headers are attached to every export request, e.g. for collector
+	// authentication.
+	Headers map[string]string
+	// SamplingRatio is the fraction in (0, 1] of root spans sampled.
+	// Non-root spans follow the sampling decision of their parent.
+	SamplingRatio float64
+	// BatchTimeout bounds how long completed spans are buffered locally
+	// before being flushed to the collector.
+	BatchTimeout time.Duration
+}
+
+// DefaultOTLPConfig returns the OTLPConfig used when tracing is enabled but
+// no explicit collector configuration has been supplied.
+func DefaultOTLPConfig() OTLPConfig {
+	return OTLPConfig{
+		SamplingRatio: 1.0,
+		BatchTimeout:  5 * time.Second,
+	}
+}
+
+// InitOTLPExporter installs a TracerProvider backed by an OTLP exporter
+// configured from cfg and registers the W3C tracecontext propagator as the
+// global propagator, so that spans started via NewTracer can be threaded
+// across the gRPC gossip and KV RPCs via context-propagated headers. It
+// returns a shutdown function that flushes and stops the provider; callers
+// should invoke it on server shutdown. An empty cfg.Endpoint disables
+// export and leaves OpenTelemetry's no-op tracer installed.
+func InitOTLPExporter(ctx context.Context, cfg OTLPConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exp sdktrace.SpanExporter
+	var err error
+	if strings.HasPrefix(cfg.Endpoint, "http://") || strings.HasPrefix(cfg.Endpoint, "https://") {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(cfg.Endpoint)}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	} else {
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(cfg.Headers))
+		}
+		exp, err = otlptracegrpc.New(ctx, opts...)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "creating OTLP trace exporter")
+	}
+
+	ratio := cfg.SamplingRatio
+	if ratio <= 0 {
+		ratio = 1.0
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp, sdktrace.WithBatchTimeout(cfg.BatchTimeout)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// grpcMetadataCarrier adapts gRPC metadata.MD to propagation.TextMapCarrier,
+// so a W3C tracecontext header can be injected into, and extracted from,
+// gRPC request metadata.
+type grpcMetadataCarrier metadata.MD
+
+func (c grpcMetadataCarrier) Get(key string) string {
+	vals := metadata.MD(c).Get(key)
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+func (c grpcMetadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c grpcMetadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// InjectTraceContext propagates the span active on ctx, if any, into md
+// using the globally configured propagator (W3C tracecontext, once
+// InitOTLPExporter has run). Callers opening a gRPC stream -- e.g. the
+// gossip client's NewGossipClient(...).Gossip(ctx) -- attach md to the
+// outgoing context so the receiving node can continue the same trace.
+func InjectTraceContext(ctx context.Context, md metadata.MD) {
+	otel.GetTextMapPropagator().Inject(ctx, grpcMetadataCarrier(md))
+}
+
+// ExtractTraceContext returns a context carrying the span context encoded
+// in md, if any, so an RPC handler can continue the caller's trace instead
+// of starting an unrelated one.
+func ExtractTraceContext(ctx context.Context, md metadata.MD) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, grpcMetadataCarrier(md))
+}
+
+// eventLogKey is the context.Value key under which a trace.EventLog (used
+// to back the /debug/events endpoint) is stashed, independent of whichever
+// span tracing implementation is active on the context.
+type eventLogKey struct{}
+
+// noEventLogKey marks a context (and its children) as having explicitly
+// opted out of event logging, even if an ancestor context carries one.
+type noEventLogKey struct{}
+
+// eventLogHolder is the value stashed under eventLogKey. It's a separate,
+// shared (pointer) allocation from the EventLog itself so that FinishEventLog
+// can mark it done in place: contexts are immutable, but every context
+// derived from the one withEventLogInternal returned shares this same
+// holder, so marking it done there is visible through all of them.
+type eventLogHolder struct {
+	el   trace.EventLog
+	done int32 // atomic
+}
+
+// withEventLogInternal returns a context with the given EventLog attached.
+// Used internally and for tests.
+func withEventLogInternal(ctx context.Context, el trace.EventLog) context.Context {
+	return context.WithValue(ctx, eventLogKey{}, &eventLogHolder{el: el})
+}
+
+// WithNoEventLog returns a context that behaves as though no ancestor
+// EventLog exists, even if one was attached further up the context chain.
+func WithNoEventLog(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noEventLogKey{}, struct{}{})
+}
+
+// eventLog returns the trace.EventLog attached to ctx, if any, not yet
+// finished, and not suppressed by WithNoEventLog.
+func eventLog(ctx context.Context) (trace.EventLog, bool) {
+	if ctx.Value(noEventLogKey{}) != nil {
+		return nil, false
+	}
+	h, ok := ctx.Value(eventLogKey{}).(*eventLogHolder)
+	if !ok || atomic.LoadInt32(&h.done) != 0 {
+		return nil, false
+	}
+	return h.el, true
+}
+
+// FinishEventLog finishes the EventLog (if any) attached to ctx -- after
+// which further Event/Eventf/etc. calls against ctx are no-ops, matching
+// trace.EventLog's own post-Finish contract -- and, if an OpenTelemetry span
+// is present and recording, ends it as well. It is safe to call on a context
+// with no EventLog or span.
+func FinishEventLog(ctx context.Context) {
+	if h, ok := ctx.Value(eventLogKey{}).(*eventLogHolder); ok {
+		if atomic.CompareAndSwapInt32(&h.done, 0, 1) {
+			h.el.Finish()
+		}
+	}
+	if sp := oteltrace.SpanFromContext(ctx); sp.IsRecording() {
+		sp.End()
+	}
+}
+
+// legacySpanFromContext adapts ctx's opentracing span (if any) so that
+// Event/VEvent/ErrEvent can keep driving it exactly as they did before this
+// package moved to OpenTelemetry. This is the compatibility shim: it lets
+// tests built around opentracing/basictracer-go (see testingTracer in
+// trace_test.go) continue to exercise the same code paths and assertions,
+// while production code now drives an OpenTelemetry span reached via
+// oteltrace.SpanFromContext below.
+func legacySpanFromContext(ctx context.Context) opentracing.Span {
+	return opentracing.SpanFromContext(ctx)
+}
+
+// otelAttrsFromTags converts the log tags attached to ctx (via
+// WithLogTag/WithLogTagInt/etc.) into OpenTelemetry attributes, so that
+// structured log tags survive the move from formatted message prefixes to
+// span attributes.
+func otelAttrsFromTags(ctx context.Context) []attribute.KeyValue {
+	// MakeMessage with an empty format yields just the formatted tag
+	// prefix (e.g. "[tag=1] "), which is the same prefix Event's legacy
+	// path bakes into the message string for the EventLog/opentracing
+	// fallbacks.
+	if tags := strings.TrimSpace(MakeMessage(ctx, "", nil)); tags != "" {
+		return []attribute.KeyValue{attribute.String("log_tags", tags)}
+	}
+	return nil
+}
+
+func eventInternal(ctx context.Context, isErr, withTags bool, format string, args []interface{}) {
+	var msg string
+	if withTags {
+		msg = MakeMessage(ctx, format, args)
+	} else {
+		msg = fmt.Sprintf(format, args...)
+	}
+
+	// A span - OpenTelemetry, or for backwards compatibility, a legacy
+	// opentracing span - takes priority over the EventLog fallback: if
+	// either is present, the event goes there and nowhere else, mirroring
+	// the pre-migration semantics exercised by TestEventLogAndTrace.
+	if sp := legacySpanFromContext(ctx); sp != nil {
+		sp.LogEvent(msg)
+		if isErr {
+			sp.SetTag("error", true)
+		}
+		return
+	}
+
+	if osp := oteltrace.SpanFromContext(ctx); osp.IsRecording() {
+		osp.AddEvent(msg, oteltrace.WithAttributes(otelAttrsFromTags(ctx)...))
+		if isErr {
+			osp.RecordError(errors.New(msg))
+			osp.SetStatus(codes.Error, msg)
+		}
+		return
+	}
+
+	if el, ok := eventLog(ctx); ok {
+		if isErr {
+			el.Errorf("%s", msg)
+		} else {
+			el.Printf("%s", msg)
+		}
+	}
+}
+
+// Event looks for an EventLog or span (OpenTelemetry or, for backwards
+// compatibility, opentracing) in the context and logs the given message to
+// it. Event-ing to a context without either is a no-op.
+func Event(ctx context.Context, msg string) {
+	eventInternal(ctx, false, true, msg, nil)
+}
+
+// Eventf is like Event but takes a format string and arguments.
+func Eventf(ctx context.Context, format string, args ...interface{}) {
+	eventInternal(ctx, false, true, format, args)
+}
+
+// VEvent is like Event but logs its message only if the given verbosity
+// level is active.
+func VEvent(level int32, ctx context.Context, msg string) {
+	if V(level) {
+		Event(ctx, msg)
+	}
+}
+
+// VEventf is like Eventf but logs its message only if the given verbosity
+// level is active.
+func VEventf(level int32, ctx context.Context, format string, args ...interface{}) {
+	if V(level) {
+		Eventf(ctx, format, args...)
+	}
+}
+
+// ErrEvent is like Event, but the message is recorded as an error: on a
+// legacy opentracing span it sets the "error" tag, and on an OpenTelemetry
+// span it records an exception and sets the span status to Error.
+func ErrEvent(ctx context.Context, msg string) {
+	eventInternal(ctx, true, true, msg, nil)
+}
+
+// ErrEventf is like ErrEvent but takes a format string and arguments.
+func ErrEventf(ctx context.Context, format string, args ...interface{}) {
+	eventInternal(ctx, true, true, format, args)
+}